@@ -0,0 +1,30 @@
+// Package blockdev provides helpers for querying properties of Linux block
+// devices that are unreliable to determine any other way, such as seeking
+// to the end of the device file to find its size.
+package blockdev
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Size returns the true byte size of the block device at path, queried via
+// the BLKGETSIZE64 ioctl. Seeking to the end of a block device's file
+// handle is not reliable on every host, so this is preferred over
+// file.Seek(0, io.SeekEnd) whenever the true device size matters, e.g.
+// deciding whether a filesystem on the device needs to be grown.
+func Size(path string) (uint64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("opening block device %s: %w", path, err)
+	}
+	defer f.Close()
+
+	size, err := unix.IoctlGetUint64(int(f.Fd()), unix.BLKGETSIZE64)
+	if err != nil {
+		return 0, fmt.Errorf("BLKGETSIZE64 on %s: %w", path, err)
+	}
+	return size, nil
+}
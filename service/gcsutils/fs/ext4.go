@@ -1,10 +1,10 @@
 package fs
 
 import (
+	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
-	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -13,17 +13,50 @@ import (
 //
 // Ext4Fs makes the following assumptions about the ext4 file system.
 //  - No journal or GDT table
-//	- Extent tree (instead of direct/indirect block addressing)
-//	- Hash tree directories (instead of linear directories)
+//	- Extent tree (instead of direct/indirect block addressing); regular
+//	  files needing more than 4 inline extents spill to a single extent
+//	  index block (no deeper extent tree)
+//	- Linear (not hash tree/HTree-indexed) directories, spilling to
+//	  additional blocks once their entries don't fit in one
 //	- Inline symlinks if < 60 chars, but no inline directories or reg files
 //  - sparse_super ext4 flags, so superblocks backups are in powers of 3, 5, 7
-// 	- Directory entries take 1 block (even though its not true)
-//  - All regular files/symlinks <= 128MB
 type Ext4Fs struct {
 	BlockSize uint64
 	InodeSize uint64
+
+	// Mode selects whether MakeFileSystem shells out to mkfs.ext4 or
+	// formats the filesystem directly in this process. Defaults to
+	// ExtWriteModeMkfsBinary for existing callers.
+	Mode ExtWriteMode
+
+	// ClusterSize enables the bigalloc feature: when nonzero, it must be a
+	// power-of-two multiple of BlockSize, and every extent allocation in
+	// the CalcXSize methods is rounded up to it instead of to BlockSize.
+	// This trades some internal fragmentation for much lower metadata
+	// overhead and faster fsck on layers with many large files. Resizing
+	// a bigalloc filesystem requires a kernel >= 4.15. MakeFileSystem
+	// passes it to mkfs.ext4; in ExtWriteModeInProcess the writer formats
+	// the image without bigalloc, so there ClusterSize only affects sizing.
+	ClusterSize uint64
+
 	totalSize uint64
 	numInodes uint64
+
+	// usedSize and usedInodes snapshot totalSize/numInodes as they stood
+	// right before FinalizeSizeContext pads them out to real allocation
+	// units; StatFS reports the gap between these and the final values as
+	// free space.
+	usedSize   uint64
+	usedInodes uint64
+}
+
+// allocUnit returns the unit CalcXSize rounds extent allocations to:
+// ClusterSize when bigalloc is enabled, BlockSize otherwise.
+func (e *Ext4Fs) allocUnit() uint64 {
+	if e.ClusterSize != 0 {
+		return e.ClusterSize
+	}
+	return e.BlockSize
 }
 
 // InitSizeContext creates the context for a new ext4 filesystem context
@@ -43,22 +76,31 @@ func (e *Ext4Fs) CalcRegFileSize(fileName string, fileSize uint64) error {
 	// 1 directory entry
 	// 1 inode
 	e.addInode()
-	e.totalSize += e.BlockSize
+	e.totalSize += e.allocUnit()
 
-	// Each extent can hold 32k blocks, so 32M of data, so 128MB can get held
-	// in the 4 extends below the i_block.
-	e.totalSize += alignN(fileSize, e.BlockSize)
+	// Each extent can hold up to 32768 blocks (128MB at the default 4K
+	// block size), and up to 4 of them fit inline in the inode. Past that
+	// the writer spills to a single extent-index block (see
+	// ext4LeafExtentCap), which needs charging for too.
+	e.totalSize += alignN(fileSize, e.allocUnit())
+	if neededExtents(alignN(fileSize, e.BlockSize)/e.BlockSize, e.BlockSize) > ext4InlineExtents {
+		e.totalSize += e.allocUnit()
+	}
 	logrus.Infof("CalcRegFileSize: %+v %s %d", e, fileName, fileSize)
 	return nil
 }
 
-// CalcDirSize calculates the space taken by the given directory on a ext4
-// file system with hash tree directories enabled.
+// CalcDirSize calculates the space taken by the given directory: 1 inode plus
+// 3 alloc units, one each for its dirent in its parent and its own "." and
+// ".." entries, which between them cover its first linear block. Spillover into additional blocks once a directory's children
+// don't fit in that first block is charged separately, once the full child
+// list is known (see chargeDirSpillover in ext4_tar.go), since that isn't
+// known yet at the point a directory's own tar/walk entry is seen.
 func (e *Ext4Fs) CalcDirSize(dirName string) error {
 	// 1 directory entry for parent.
 	// 1 inode with 2 directory entries ("." & ".." as data
 	e.addInode()
-	e.totalSize += 3 * e.BlockSize
+	e.totalSize += 3 * e.allocUnit()
 	logrus.Infof("CalcDirSize: %+v %s", e, dirName)
 	return nil
 }
@@ -69,7 +111,7 @@ func (e *Ext4Fs) CalcSymlinkSize(srcName string, dstName string) error {
 	e.addInode()
 	if len(dstName) > 60 {
 		// Not an inline symlink. The path is 1 extent max since MAX_PATH=4096
-		e.totalSize += alignN(uint64(len(dstName)), e.BlockSize)
+		e.totalSize += alignN(uint64(len(dstName)), e.allocUnit())
 	}
 	logrus.Infof("CalcSynlinkSize: %+v %s %s", e, srcName, dstName)
 	return nil
@@ -122,12 +164,22 @@ func (e *Ext4Fs) CalcAddExAttrSize(fileName string, attr string, data []byte, fl
 // It does some final size adjustments.
 func (e *Ext4Fs) FinalizeSizeContext() error {
 	logrus.Infof("FinalizeSizeContext Entry: %+v", e)
-	// Final adjustments to the size + inode
-	// There are more metadata like Inode Table, block table.
-	// For now, add 15% more to the size to take account for it, and
-	// 10% more inodes. See https://github.com/moby/moby/issues/36353
-	e.totalSize = uint64(float64(e.totalSize) * 1.50)
-	e.numInodes = uint64(float64(e.numInodes) * 1.50)
+
+	e.usedSize = e.totalSize
+	e.usedInodes = e.numInodes
+
+	if e.Mode == ExtWriteModeInProcess {
+		// The in-process writer knows exactly how many bitmap, inode
+		// table and backup-superblock/GDT blocks each group needs, so it
+		// doesn't need the fudge factor below.
+		e.addExactOverhead()
+	} else {
+		// There are more metadata like Inode Table, block table.
+		// For now, add 15% more to the size to take account for it, and
+		// 10% more inodes. See https://github.com/moby/moby/issues/36353
+		e.totalSize = uint64(float64(e.totalSize) * 1.50)
+		e.numInodes = uint64(float64(e.numInodes) * 1.50)
+	}
 
 	// Align to 64 * blocksize
 	if e.totalSize%(64*e.BlockSize) != 0 {
@@ -139,7 +191,42 @@ func (e *Ext4Fs) FinalizeSizeContext() error {
 
 // GetSizeInfo returns the size of the ext4 file system after the size context is finalized.
 func (e *Ext4Fs) GetSizeInfo() FilesystemSizeInfo {
-	return FilesystemSizeInfo{NumInodes: e.numInodes, TotalSize: e.totalSize}
+	return FilesystemSizeInfo{
+		NumInodes:  e.numInodes,
+		TotalSize:  e.totalSize,
+		UsedInodes: e.usedInodes,
+		UsedSize:   e.usedSize,
+	}
+}
+
+// StatFS returns POSIX-statvfs-style usage info for the image this Ext4Fs
+// sized, e.g. so a caller can report the `df` output a container will see
+// without mounting the image. Only valid after FinalizeSizeContext.
+func (e *Ext4Fs) StatFS() StatFS {
+	info := e.GetSizeInfo()
+
+	blocks := info.TotalSize / e.BlockSize
+	usedBlocks := alignN(info.UsedSize, e.BlockSize) / e.BlockSize
+	var freeBlocks uint64
+	if blocks > usedBlocks {
+		freeBlocks = blocks - usedBlocks
+	}
+
+	var freeInodes uint64
+	if info.NumInodes > info.UsedInodes {
+		freeInodes = info.NumInodes - info.UsedInodes
+	}
+
+	return StatFS{
+		BlockSize:    e.BlockSize,
+		FragmentSize: e.BlockSize, // ext4 has no sub-block fragments
+		Blocks:       blocks,
+		FreeBlocks:   freeBlocks,
+		AvailBlocks:  freeBlocks, // no reserved-blocks percentage modeled here
+		Files:        info.NumInodes,
+		FreeFiles:    freeInodes,
+		MaxNameLen:   255, // EXT4_NAME_LEN
+	}
 }
 
 // CleanupSizeContext frees any resources needed by the ext4 file system
@@ -150,27 +237,38 @@ func (e *Ext4Fs) CleanupSizeContext() error {
 
 // MakeFileSystem writes an ext4 filesystem to the given file after the size context is finalized.
 func (e *Ext4Fs) MakeFileSystem(file *os.File) error {
+	logrus.Infof("making file system with: bs=%d is=%d numi=%d size=%d mode=%d",
+		e.BlockSize, e.InodeSize, e.numInodes, e.totalSize, e.Mode)
+
+	if e.Mode == ExtWriteModeInProcess {
+		if err := e.writeExt4Image(file); err != nil {
+			return fmt.Errorf("writing ext4 image to %s: %w", file.Name(), err)
+		}
+		return nil
+	}
+
 	blockSize := strconv.FormatUint(e.BlockSize, 10)
 	inodeSize := strconv.FormatUint(e.InodeSize, 10)
 	numInodes := strconv.FormatUint(e.numInodes, 10)
-	logrus.Infof("making file system with: bs=%d is=%d numi=%d size=%d",
-		e.BlockSize, e.InodeSize, e.numInodes, e.totalSize)
 
-	err := exec.Command(
-		"mkfs.ext4",
-		"-O", "^has_journal,^resize_inode",
+	features := "^has_journal,^resize_inode"
+	args := []string{
+		"-O", features,
 		"-N", numInodes,
 		"-b", blockSize,
 		"-I", inodeSize,
-		"-F",
-		file.Name()).Run()
+	}
+	if e.ClusterSize != 0 {
+		args[1] = features + ",bigalloc"
+		args = append(args, "-C", strconv.FormatUint(e.ClusterSize, 10))
+	}
+	args = append(args, "-F", file.Name())
 
-	if err != nil {
-		logrus.Infof("running mkfs.ext4 %s failed with ... (%s)", file.Name(), err)
-		time.Sleep(100 * time.Hour)
+	if err := exec.Command("mkfs.ext4", args...).Run(); err != nil {
+		return fmt.Errorf("running mkfs.ext4 on %s: %w", file.Name(), err)
 	}
 
-	return err
+	return nil
 }
 
 // MakeBasicFileSystem just creates an empty file system on the given file using
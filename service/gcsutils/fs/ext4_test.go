@@ -0,0 +1,103 @@
+package fs
+
+import "testing"
+
+// TestClusterSizeRoundsToCluster checks that enabling bigalloc (ClusterSize)
+// rounds extent allocations up to the cluster instead of the block, per the
+// caveat documented on Ext4Fs.ClusterSize.
+func TestClusterSizeRoundsToCluster(t *testing.T) {
+	const blockSize = 4096
+	const clusterSize = 4 * blockSize
+
+	withCluster := &Ext4Fs{BlockSize: blockSize, InodeSize: 256, ClusterSize: clusterSize}
+	if err := withCluster.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+	before := withCluster.totalSize
+	// One byte of file data should still consume a whole cluster, not a
+	// whole block.
+	if err := withCluster.CalcRegFileSize("f", 1); err != nil {
+		t.Fatalf("CalcRegFileSize: %v", err)
+	}
+	// CalcRegFileSize charges one alloc unit for the directory entry and
+	// one (rounded up) for the data itself, on top of the inode.
+	got := withCluster.totalSize - before - withCluster.InodeSize
+	want := uint64(2 * clusterSize)
+	if got != want {
+		t.Fatalf("1-byte file consumed %d bytes with ClusterSize=%d, want %d", got, clusterSize, want)
+	}
+
+	withoutCluster := &Ext4Fs{BlockSize: blockSize, InodeSize: 256}
+	if err := withoutCluster.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+	before = withoutCluster.totalSize
+	if err := withoutCluster.CalcRegFileSize("f", 1); err != nil {
+		t.Fatalf("CalcRegFileSize: %v", err)
+	}
+	got = withoutCluster.totalSize - before - withoutCluster.InodeSize
+	want = uint64(2 * blockSize)
+	if got != want {
+		t.Fatalf("1-byte file consumed %d bytes with no ClusterSize, want %d", got, want)
+	}
+}
+
+// TestCalcRegFileSizeChargesExtentIndexBlock checks that a file needing more
+// than ext4InlineExtents extents is charged an extra alloc unit for the
+// extent-index block writeExtentList spills its extent list into once the
+// writer gets to it.
+func TestCalcRegFileSizeChargesExtentIndexBlock(t *testing.T) {
+	const blockSize = 4096
+	e := &Ext4Fs{BlockSize: blockSize, InodeSize: 256}
+	if err := e.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+
+	maxInlineBytes := uint64(ext4InlineExtents) * uint64(blocksPerGroupFor(blockSize)) * blockSize
+
+	before := e.totalSize
+	if err := e.CalcRegFileSize("fits.bin", maxInlineBytes); err != nil {
+		t.Fatalf("CalcRegFileSize (fits inline): %v", err)
+	}
+	gotInline := e.totalSize - before - e.InodeSize - alignN(maxInlineBytes, e.allocUnit())
+	if gotInline != e.allocUnit() {
+		t.Fatalf("a file using exactly %d extents charged %d bytes beyond inode+data, want %d (just the dirent)", ext4InlineExtents, gotInline, e.allocUnit())
+	}
+
+	before = e.totalSize
+	if err := e.CalcRegFileSize("spills.bin", maxInlineBytes+1); err != nil {
+		t.Fatalf("CalcRegFileSize (needs an extent-index block): %v", err)
+	}
+	gotSpill := e.totalSize - before - e.InodeSize - alignN(maxInlineBytes+1, e.allocUnit())
+	if gotSpill != 2*e.allocUnit() {
+		t.Fatalf("a file needing more than %d extents charged %d bytes beyond inode+data, want %d (dirent + extent-index block)", ext4InlineExtents, gotSpill, 2*e.allocUnit())
+	}
+}
+
+// TestFinalizeSizeContextInProcessExact checks that the in-process writer's
+// sizing pass doesn't apply the legacy 1.50x fudge factor, since it knows
+// the exact metadata cost.
+func TestFinalizeSizeContextInProcessExact(t *testing.T) {
+	e := &Ext4Fs{BlockSize: 4096, InodeSize: 256, Mode: ExtWriteModeInProcess}
+	if err := e.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+	if err := e.CalcRegFileSize("f", 4096); err != nil {
+		t.Fatalf("CalcRegFileSize: %v", err)
+	}
+	before := e.totalSize
+	beforeInodes := e.numInodes
+	if err := e.FinalizeSizeContext(); err != nil {
+		t.Fatalf("FinalizeSizeContext: %v", err)
+	}
+	// The exact-overhead path keeps the inode count exact (11 reserved +
+	// the file, all in one group) where the legacy path scales it by 1.50x
+	// (12 -> 18). Both paths then round totalSize up to a multiple of 64
+	// blocks, which for an image this small is exactly 64 blocks.
+	if e.numInodes != beforeInodes {
+		t.Fatalf("numInodes grew from %d to %d, looks like the 1.50x fudge factor is still applied in-process", beforeInodes, e.numInodes)
+	}
+	if want := uint64(64 * 4096); e.totalSize != want {
+		t.Fatalf("totalSize grew from %d to %d, want %d", before, e.totalSize, want)
+	}
+}
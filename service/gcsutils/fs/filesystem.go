@@ -0,0 +1,67 @@
+package fs
+
+import "os"
+
+// Filesystem is implemented by the filesystem-specific sizing/image-building
+// backends (Ext4Fs, XfsFs, ...). Callers drive it in two phases: first a
+// dry-run sizing pass made up of the CalcXSize calls for every entry that
+// will go into the image, finished off by FinalizeSizeContext/GetSizeInfo,
+// then MakeFileSystem to actually lay the filesystem down on disk.
+type Filesystem interface {
+	// InitSizeContext resets the size accounting for a new image.
+	InitSizeContext() error
+
+	CalcRegFileSize(fileName string, fileSize uint64) error
+	CalcDirSize(dirName string) error
+	CalcSymlinkSize(srcName string, dstName string) error
+	CalcHardlinkSize(srcName string, dstName string) error
+	CalcCharDeviceSize(devName string, major uint64, minor uint64) error
+	CalcBlockDeviceSize(devName string, major uint64, minor uint64) error
+	CalcFIFOPipeSize(pipeName string) error
+	CalcSocketSize(sockName string) error
+	CalcAddExAttrSize(fileName string, attr string, data []byte, flags int) error
+
+	// FinalizeSizeContext should be called once all of the CalcXSize calls
+	// for the image are done, to let the backend apply any final rounding.
+	FinalizeSizeContext() error
+	// GetSizeInfo returns the computed size of the image. Only valid after
+	// FinalizeSizeContext.
+	GetSizeInfo() FilesystemSizeInfo
+	// CleanupSizeContext releases any resources acquired during sizing.
+	CleanupSizeContext() error
+
+	// MakeFileSystem writes the filesystem to file. file must already be at
+	// least GetSizeInfo().TotalSize bytes.
+	MakeFileSystem(file *os.File) error
+}
+
+// FilesystemSizeInfo describes the size of an image computed by a
+// Filesystem's CalcXSize/FinalizeSizeContext pass.
+type FilesystemSizeInfo struct {
+	NumInodes uint64
+	TotalSize uint64
+
+	// UsedInodes and UsedSize are the inodes and bytes actually consumed
+	// by the entries passed to the CalcXSize calls, before
+	// FinalizeSizeContext pads NumInodes/TotalSize out to the backend's
+	// real on-disk allocation units (inode table padding, bigalloc
+	// rounding, sparse_super backups, ...). The gap between these and
+	// NumInodes/TotalSize is what StatFS reports as free. Ext4Fs fills
+	// these in; XfsFs leaves them zero.
+	UsedInodes uint64
+	UsedSize   uint64
+}
+
+// StatFS mirrors the subset of POSIX statvfs(2) fields a caller needs to
+// report df-style usage for an image built by a Filesystem, without
+// mounting it.
+type StatFS struct {
+	BlockSize    uint64 // f_bsize
+	FragmentSize uint64 // f_frsize
+	Blocks       uint64 // f_blocks: total blocks
+	FreeBlocks   uint64 // f_bfree
+	AvailBlocks  uint64 // f_bavail: blocks available to unprivileged users
+	Files        uint64 // f_files: total inodes
+	FreeFiles    uint64 // f_ffree
+	MaxNameLen   uint64 // f_namemax
+}
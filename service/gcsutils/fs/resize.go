@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/ahmelsayed/opengcs/service/gcsutils/blockdev"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+// Resizable is implemented by filesystem backends that support growing an
+// already-formatted image in place, e.g. after a snapshot restore onto a
+// larger disk.
+type Resizable interface {
+	// Grow extends the filesystem on file to newSize bytes. file must
+	// already be (or be truncatable to) at least newSize bytes.
+	Grow(file *os.File, newSize uint64) error
+
+	// NeedsResize reports whether the filesystem mounted from devicePath
+	// at mountPath is smaller than its backing block device.
+	NeedsResize(devicePath string, mountPath string) (bool, error)
+}
+
+// Grow extends an ext4 filesystem to newSize by running e2fsck (required
+// before resize2fs will touch a filesystem that wasn't cleanly unmounted)
+// followed by resize2fs. Once the pure-Go writer can grow a filesystem in
+// place, an ExtWriteModeInProcess fallback belongs here instead.
+func (e *Ext4Fs) Grow(file *os.File, newSize uint64) error {
+	if err := file.Truncate(int64(newSize)); err != nil {
+		return fmt.Errorf("truncating %s to %d bytes: %w", file.Name(), newSize, err)
+	}
+
+	if err := exec.Command("e2fsck", "-f", "-y", file.Name()).Run(); err != nil {
+		return fmt.Errorf("running e2fsck on %s: %w", file.Name(), err)
+	}
+	if err := exec.Command("resize2fs", file.Name()).Run(); err != nil {
+		return fmt.Errorf("running resize2fs on %s: %w", file.Name(), err)
+	}
+
+	logrus.Infof("Grow: resized %s to %d bytes", file.Name(), newSize)
+	return nil
+}
+
+// NeedsResize reports whether devicePath's filesystem is smaller than the
+// block device backing it. This is the shape of the snapshot-restore case:
+// opengcs mounts a layer whose backing VHD was expanded, and needs to tell
+// whether the filesystem inside it should be grown to match.
+func (e *Ext4Fs) NeedsResize(devicePath string, mountPath string) (bool, error) {
+	deviceSize, err := blockdev.Size(devicePath)
+	if err != nil {
+		return false, err
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(mountPath, &stat); err != nil {
+		return false, fmt.Errorf("statfs %s: %w", mountPath, err)
+	}
+	fsSize := stat.Blocks * uint64(stat.Bsize)
+
+	logrus.Infof("NeedsResize: device=%d bytes fs=%d bytes", deviceSize, fsSize)
+	return fsSize < deviceSize, nil
+}
@@ -0,0 +1,153 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// WalkAndSize walks the host directory tree rooted at root, calling the
+// matching Filesystem CalcXSize method for every entry under it. This
+// turns any Filesystem implementation into a "how big a VHD do I need to
+// hold this tree" calculator, without having to lay the tree out on a
+// loop-mounted image first.
+//
+// Regular files are sized by their allocated block count (st_blocks*512)
+// rather than their apparent size, so sparse files aren't charged for
+// space they won't actually take up in the image. Files with more than
+// one hardlink are only charged once, on first sight of their inode
+// number; every later path sharing that inode is reported via
+// CalcHardlinkSize instead. Extended attributes are read with
+// llistxattr/lgetxattr and passed to CalcAddExAttrSize.
+//
+// Callers must call fsys.InitSizeContext before WalkAndSize and
+// fsys.FinalizeSizeContext after it returns.
+func WalkAndSize(root string, fsys Filesystem) error {
+	seenInodes := make(map[uint64]string)
+
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			// The root of the tree being sized isn't itself an entry in it.
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return fmt.Errorf("relativizing %s against %s: %w", path, root, err)
+		}
+
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return fmt.Errorf("no syscall.Stat_t for %s", path)
+		}
+
+		isSymlink := info.Mode()&os.ModeSymlink != 0
+		if !isSymlink && !info.IsDir() && st.Nlink > 1 {
+			if firstPath, ok := seenInodes[st.Ino]; ok {
+				if err := fsys.CalcHardlinkSize(rel, firstPath); err != nil {
+					return err
+				}
+				return addXAttrs(fsys, path, rel)
+			}
+			seenInodes[st.Ino] = rel
+		}
+
+		switch {
+		case isSymlink:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return fmt.Errorf("reading symlink %s: %w", path, err)
+			}
+			if err := fsys.CalcSymlinkSize(rel, target); err != nil {
+				return err
+			}
+		case info.IsDir():
+			if err := fsys.CalcDirSize(rel); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeCharDevice != 0:
+			if err := fsys.CalcCharDeviceSize(rel, uint64(unix.Major(st.Rdev)), uint64(unix.Minor(st.Rdev))); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeDevice != 0:
+			if err := fsys.CalcBlockDeviceSize(rel, uint64(unix.Major(st.Rdev)), uint64(unix.Minor(st.Rdev))); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeNamedPipe != 0:
+			if err := fsys.CalcFIFOPipeSize(rel); err != nil {
+				return err
+			}
+		case info.Mode()&os.ModeSocket != 0:
+			if err := fsys.CalcSocketSize(rel); err != nil {
+				return err
+			}
+		default:
+			if err := fsys.CalcRegFileSize(rel, uint64(st.Blocks)*512); err != nil {
+				return err
+			}
+		}
+
+		return addXAttrs(fsys, path, rel)
+	})
+}
+
+// addXAttrs reads every extended attribute on path and passes it to
+// fsys.CalcAddExAttrSize under rel, the attribute's path in the image.
+func addXAttrs(fsys Filesystem, path string, rel string) error {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil {
+		if err == unix.ENOTSUP || err == unix.EOPNOTSUPP {
+			return nil
+		}
+		return fmt.Errorf("listing xattrs on %s: %w", path, err)
+	}
+	if size == 0 {
+		return nil
+	}
+
+	names := make([]byte, size)
+	if _, err := unix.Llistxattr(path, names); err != nil {
+		return fmt.Errorf("listing xattrs on %s: %w", path, err)
+	}
+
+	for _, name := range splitXAttrNames(names) {
+		dataSize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			return fmt.Errorf("reading xattr %s on %s: %w", name, path, err)
+		}
+		var data []byte
+		if dataSize > 0 {
+			data = make([]byte, dataSize)
+			if _, err := unix.Lgetxattr(path, name, data); err != nil {
+				return fmt.Errorf("reading xattr %s on %s: %w", name, path, err)
+			}
+		}
+		if err := fsys.CalcAddExAttrSize(rel, name, data, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitXAttrNames splits the NUL-separated attribute name list returned by
+// listxattr(2) into individual names.
+func splitXAttrNames(buf []byte) []string {
+	var names []string
+	start := 0
+	for i, b := range buf {
+		if b != 0 {
+			continue
+		}
+		if i > start {
+			names = append(names, string(buf[start:i]))
+		}
+		start = i + 1
+	}
+	return names
+}
@@ -0,0 +1,183 @@
+package fs
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// recordingFS is a minimal Filesystem that just records what WalkAndSize
+// calls it with, so tests can assert on the walk's behavior without
+// depending on any particular backend's sizing math.
+type recordingFS struct {
+	regFiles  map[string]uint64
+	hardlinks map[string]string
+	symlinks  map[string]string
+	xattrs    map[string][]string
+}
+
+func newRecordingFS() *recordingFS {
+	return &recordingFS{
+		regFiles:  make(map[string]uint64),
+		hardlinks: make(map[string]string),
+		symlinks:  make(map[string]string),
+		xattrs:    make(map[string][]string),
+	}
+}
+
+func (r *recordingFS) InitSizeContext() error     { return nil }
+func (r *recordingFS) FinalizeSizeContext() error { return nil }
+func (r *recordingFS) GetSizeInfo() FilesystemSizeInfo { return FilesystemSizeInfo{} }
+func (r *recordingFS) CleanupSizeContext() error  { return nil }
+func (r *recordingFS) MakeFileSystem(file *os.File) error { return nil }
+
+func (r *recordingFS) CalcRegFileSize(fileName string, fileSize uint64) error {
+	r.regFiles[fileName] = fileSize
+	return nil
+}
+func (r *recordingFS) CalcDirSize(dirName string) error { return nil }
+func (r *recordingFS) CalcSymlinkSize(srcName, dstName string) error {
+	r.symlinks[srcName] = dstName
+	return nil
+}
+func (r *recordingFS) CalcHardlinkSize(srcName, dstName string) error {
+	r.hardlinks[srcName] = dstName
+	return nil
+}
+func (r *recordingFS) CalcCharDeviceSize(devName string, major, minor uint64) error  { return nil }
+func (r *recordingFS) CalcBlockDeviceSize(devName string, major, minor uint64) error { return nil }
+func (r *recordingFS) CalcFIFOPipeSize(pipeName string) error                        { return nil }
+func (r *recordingFS) CalcSocketSize(sockName string) error                          { return nil }
+func (r *recordingFS) CalcAddExAttrSize(fileName, attr string, data []byte, flags int) error {
+	r.xattrs[fileName] = append(r.xattrs[fileName], attr)
+	return nil
+}
+
+// TestWalkAndSizeHardlinksAndSymlinks checks that WalkAndSize sizes the
+// first path to an inode as a regular file, every later path sharing that
+// inode via CalcHardlinkSize, and symlinks via CalcSymlinkSize with their
+// target. filepath.Walk visits names in lexical order, so "a-link.txt" is
+// the first path seen for the inode it shares with "a.txt".
+func TestWalkAndSizeHardlinksAndSymlinks(t *testing.T) {
+	root := t.TempDir()
+
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("writing a.txt: %v", err)
+	}
+	if err := os.Link(filepath.Join(root, "a.txt"), filepath.Join(root, "a-link.txt")); err != nil {
+		t.Fatalf("linking a-link.txt: %v", err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(root, "a-sym.txt")); err != nil {
+		t.Fatalf("symlinking a-sym.txt: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("mkdir sub: %v", err)
+	}
+
+	fsys := newRecordingFS()
+	if err := WalkAndSize(root, fsys); err != nil {
+		t.Fatalf("WalkAndSize: %v", err)
+	}
+
+	regCount := 0
+	for name := range fsys.regFiles {
+		if name == "a.txt" || name == "a-link.txt" {
+			regCount++
+		}
+	}
+	if regCount != 1 {
+		t.Fatalf("both a.txt and a-link.txt were sized as regular files (%d), want only the first", regCount)
+	}
+	if _, ok := fsys.regFiles["a-link.txt"]; !ok {
+		t.Fatalf("a-link.txt (the first path seen for its inode) wasn't sized as a regular file: %+v", fsys.regFiles)
+	}
+	if target, ok := fsys.hardlinks["a.txt"]; !ok || target != "a-link.txt" {
+		t.Fatalf("a.txt wasn't charged as a hardlink to a-link.txt, got %+v", fsys.hardlinks)
+	}
+	if target, ok := fsys.symlinks["a-sym.txt"]; !ok || target != "a.txt" {
+		t.Fatalf("a-sym.txt wasn't sized as a symlink to a.txt, got %+v", fsys.symlinks)
+	}
+}
+
+// TestWalkAndSizeUsesAllocatedBlocks checks that regular files are sized by
+// st_blocks*512 (true on-disk usage), not st_size, so a sparse file isn't
+// charged for the space it doesn't actually take up.
+func TestWalkAndSizeUsesAllocatedBlocks(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "sparse.bin")
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("creating sparse.bin: %v", err)
+	}
+	// A 1MiB hole followed by a few real bytes: apparent size is ~1MiB,
+	// but only one block is actually allocated.
+	if _, err := f.WriteAt([]byte("x"), 1<<20); err != nil {
+		t.Fatalf("writing past the hole: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatalf("closing sparse.bin: %v", err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if fi.Size() < 1<<20 {
+		t.Skip("filesystem didn't report the expected apparent size")
+	}
+
+	fsys := newRecordingFS()
+	if err := WalkAndSize(root, fsys); err != nil {
+		t.Fatalf("WalkAndSize: %v", err)
+	}
+
+	got, ok := fsys.regFiles["sparse.bin"]
+	if !ok {
+		t.Fatalf("sparse.bin wasn't sized as a regular file: %+v", fsys.regFiles)
+	}
+	if got >= uint64(fi.Size()) {
+		t.Fatalf("sparse.bin sized at %d bytes (apparent size %d); want it charged for allocated blocks, not apparent size", got, fi.Size())
+	}
+}
+
+// BenchmarkWalkAndSizeVsDu times WalkAndSize against `du -sk` (which, like
+// WalkAndSize, counts allocated blocks; `du -sk --apparent-size` would
+// overcount sparse files) over a generated tree, as two sub-benchmarks, so
+// a regression in the walk shows up next to the equivalent shell-out cost.
+// It compares durations only, not the sizes the two report.
+func BenchmarkWalkAndSizeVsDu(b *testing.B) {
+	duPath, err := exec.LookPath("du")
+	if err != nil {
+		b.Skip("du not available")
+	}
+
+	root := b.TempDir()
+	const numFiles = 200
+	for i := 0; i < numFiles; i++ {
+		name := filepath.Join(root, "file-"+strconv.Itoa(i)+".bin")
+		if err := os.WriteFile(name, make([]byte, 4096*(i%5+1)), 0644); err != nil {
+			b.Fatalf("writing %s: %v", name, err)
+		}
+	}
+
+	b.Run("WalkAndSize", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			fsys := newRecordingFS()
+			if err := WalkAndSize(root, fsys); err != nil {
+				b.Fatalf("WalkAndSize: %v", err)
+			}
+		}
+	})
+
+	b.Run("du", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if out, err := exec.Command(duPath, "-sk", root).CombinedOutput(); err != nil {
+				b.Fatalf("du: %v (%s)", err, strings.TrimSpace(string(out)))
+			}
+		}
+	})
+}
@@ -0,0 +1,234 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// xfsMaxAGBytes is mkfs.xfs's own default cap on allocation group
+	// size; it picks enough AGs of up to this size to cover the image.
+	xfsMaxAGBytes = 4 * 1024 * 1024 * 1024
+
+	// xfsInodesPerChunk is the fixed number of inodes XFS allocates (and
+	// tracks with a single inode B+tree record) at a time.
+	xfsInodesPerChunk = 64
+
+	// xfsICoreSize is the fixed on-disk size of an XFS inode's core
+	// (dinode_core); the rest of InodeSize is the inode's literal area,
+	// which holds short-form directory entries, inline symlink targets,
+	// or inline data, depending on the inode's format.
+	xfsICoreSize = 176
+
+	// xfsShortFormDirEntry is the fixed per-entry overhead (ino + namelen
+	// + tag) in a short-form directory's literal area, not counting the
+	// entry's name.
+	xfsShortFormDirEntry = 8
+)
+
+// XfsFs implements the Filesystem interface for XFS.
+//
+// XfsFs makes the following assumptions about the XFS file system:
+//  - One allocation group per up to 4GiB of image, the same cap mkfs.xfs
+//    itself uses to pick an AG count
+//  - Inodes are allocated in fixed 64-inode chunks (one inode B+tree record)
+//  - Directories small enough to fit in their inode's literal area use
+//    XFS's short-form format; anything bigger spills to a single
+//    block-form directory block (no btree-form directories, since the
+//    layers this package builds are small)
+//  - Regular files are held by a single extent, since these images are
+//    written once by a single sequential pass rather than grown in place
+//
+// Like Ext4Fs, CalcRegFileSize/CalcSymlinkSize/etc. don't know which
+// directory their entry belongs to, so every entry is attributed to
+// whichever directory CalcDirSize most recently sized.
+type XfsFs struct {
+	BlockSize uint64
+	InodeSize uint64
+
+	totalSize uint64
+	numInodes uint64
+
+	curDirInlineBytes uint64
+	curDirOverflowed  bool
+}
+
+// InitSizeContext creates the context for a new XFS filesystem context.
+// Before calling set x.BlockSize and x.InodeSize to the desired values.
+func (x *XfsFs) InitSizeContext() error {
+	x.numInodes = 1 // the root inode
+	x.totalSize = 2 * x.BlockSize
+
+	logrus.Infof("InitSizeContext: %+v", x)
+	return nil
+}
+
+// CalcRegFileSize calculates the space taken by the given regular file on
+// an XFS file system.
+func (x *XfsFs) CalcRegFileSize(fileName string, fileSize uint64) error {
+	x.addInode()
+	x.addDirEntry(fileName)
+	x.totalSize += alignN(fileSize, x.BlockSize)
+	logrus.Infof("CalcRegFileSize: %+v %s %d", x, fileName, fileSize)
+	return nil
+}
+
+// CalcDirSize calculates the space taken by the given directory, and makes
+// it the current short-form directory that subsequent entries are charged
+// against.
+func (x *XfsFs) CalcDirSize(dirName string) error {
+	x.addInode()
+	x.curDirInlineBytes = 0
+	x.curDirOverflowed = false
+	logrus.Infof("CalcDirSize: %+v %s", x, dirName)
+	return nil
+}
+
+// CalcSymlinkSize calculates the space taken by a symlink, taking account
+// for symlink targets short enough to live inline in the inode's literal
+// area.
+func (x *XfsFs) CalcSymlinkSize(srcName string, dstName string) error {
+	x.addInode()
+	x.addDirEntry(srcName)
+	if uint64(len(dstName)) > x.InodeSize-xfsICoreSize {
+		x.totalSize += alignN(uint64(len(dstName)), x.BlockSize)
+	}
+	logrus.Infof("CalcSymlinkSize: %+v %s %s", x, srcName, dstName)
+	return nil
+}
+
+// CalcHardlinkSize calculates the space taken by a hardlink.
+func (x *XfsFs) CalcHardlinkSize(srcName string, dstName string) error {
+	x.addDirEntry(srcName)
+	logrus.Infof("CalcHardlinkSize: %+v %s %s", x, srcName, dstName)
+	return nil
+}
+
+// CalcCharDeviceSize calculates the space taken by a char device.
+func (x *XfsFs) CalcCharDeviceSize(devName string, major uint64, minor uint64) error {
+	x.addInode()
+	x.addDirEntry(devName)
+	logrus.Infof("CalcCharDeviceSize: %+v %s %d %d", x, devName, major, minor)
+	return nil
+}
+
+// CalcBlockDeviceSize calculates the space taken by a block device.
+func (x *XfsFs) CalcBlockDeviceSize(devName string, major uint64, minor uint64) error {
+	x.addInode()
+	x.addDirEntry(devName)
+	logrus.Infof("CalcBlockDeviceSize: %+v %s %d %d", x, devName, major, minor)
+	return nil
+}
+
+// CalcFIFOPipeSize calculates the space taken by a fifo pipe.
+func (x *XfsFs) CalcFIFOPipeSize(pipeName string) error {
+	x.addInode()
+	x.addDirEntry(pipeName)
+	logrus.Infof("CalcFIFOPipeSize: %+v %s", x, pipeName)
+	return nil
+}
+
+// CalcSocketSize calculates the space taken by a socket.
+func (x *XfsFs) CalcSocketSize(sockName string) error {
+	x.addInode()
+	x.addDirEntry(sockName)
+	logrus.Infof("CalcSocketSize: %+v %s", x, sockName)
+	return nil
+}
+
+// CalcAddExAttrSize calculates the space taken by extended attributes.
+// Like Ext4Fs, this assumes attributes are small enough to fit inline in
+// the inode's literal area alongside a short-form directory or symlink.
+func (x *XfsFs) CalcAddExAttrSize(fileName string, attr string, data []byte, flags int) error {
+	logrus.Infof("CalcAddExAttrSize: %+v %s", x, fileName)
+	return nil
+}
+
+// addDirEntry charges name's directory entry against the short-form
+// literal area of the most recently sized directory, spilling to a single
+// block-form directory block the first time that area overflows.
+func (x *XfsFs) addDirEntry(name string) {
+	if x.curDirOverflowed {
+		return // already paying for the block-form directory block
+	}
+	cost := uint64(xfsShortFormDirEntry + len(name))
+	if x.curDirInlineBytes+cost <= x.InodeSize-xfsICoreSize {
+		x.curDirInlineBytes += cost
+		return
+	}
+	x.curDirOverflowed = true
+	x.totalSize += x.BlockSize
+}
+
+// FinalizeSizeContext should be called after all of the CalcXSize methods
+// are done. It adds the fixed per-allocation-group and inode-chunk
+// overhead that the CalcXSize calls don't otherwise account for.
+func (x *XfsFs) FinalizeSizeContext() error {
+	logrus.Infof("FinalizeSizeContext Entry: %+v", x)
+
+	// Inodes are allocated (and tracked by the inode B+tree) in fixed
+	// 64-inode chunks.
+	x.numInodes = alignN(x.numInodes, xfsInodesPerChunk)
+	chunks := x.numInodes / xfsInodesPerChunk
+	x.totalSize += chunks * alignN(xfsInodesPerChunk*x.InodeSize, x.BlockSize)
+
+	// One AG per up to 4GiB, the same cap mkfs.xfs uses.
+	numAGs := (x.totalSize + xfsMaxAGBytes - 1) / xfsMaxAGBytes
+	if numAGs == 0 {
+		numAGs = 1
+	}
+	// Superblock, AGF, AGI and AGFL headers: one block each, per AG.
+	x.totalSize += numAGs * 4 * x.BlockSize
+
+	x.totalSize = alignN(x.totalSize, x.BlockSize)
+	logrus.Infof("FinalizeSizeContext Exit: %+v", x)
+	return nil
+}
+
+// GetSizeInfo returns the size of the XFS file system after the size
+// context is finalized.
+func (x *XfsFs) GetSizeInfo() FilesystemSizeInfo {
+	return FilesystemSizeInfo{NumInodes: x.numInodes, TotalSize: x.totalSize}
+}
+
+// CleanupSizeContext frees any resources needed by the XFS file system.
+func (x *XfsFs) CleanupSizeContext() error {
+	return nil
+}
+
+// MakeFileSystem writes an XFS filesystem to the given file after the size
+// context is finalized.
+func (x *XfsFs) MakeFileSystem(file *os.File) error {
+	blockSize := strconv.FormatUint(x.BlockSize, 10)
+	inodeSize := strconv.FormatUint(x.InodeSize, 10)
+
+	logrus.Infof("making XFS file system with: bs=%d is=%d numi=%d size=%d",
+		x.BlockSize, x.InodeSize, x.numInodes, x.totalSize)
+
+	err := exec.Command(
+		"mkfs.xfs",
+		"-b", "size="+blockSize,
+		"-i", "size="+inodeSize,
+		"-f",
+		file.Name()).Run()
+
+	if err != nil {
+		return fmt.Errorf("running mkfs.xfs on %s: %w", file.Name(), err)
+	}
+
+	return nil
+}
+
+// MakeBasicFileSystem just creates an empty file system on the given file
+// using the default settings.
+func (x *XfsFs) MakeBasicFileSystem(file *os.File) error {
+	return exec.Command("mkfs.xfs", "-f", file.Name()).Run()
+}
+
+func (x *XfsFs) addInode() {
+	x.numInodes++
+}
@@ -0,0 +1,53 @@
+package fs
+
+import "testing"
+
+// TestXfsFsShortFormDirOverflow checks that addDirEntry only charges a
+// block once a directory's entries overflow its inode's short-form literal
+// area, and not again for every entry after that.
+func TestXfsFsShortFormDirOverflow(t *testing.T) {
+	x := &XfsFs{BlockSize: 4096, InodeSize: 512}
+	if err := x.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+	if err := x.CalcDirSize("d"); err != nil {
+		t.Fatalf("CalcDirSize: %v", err)
+	}
+
+	before := x.totalSize
+	literalArea := x.InodeSize - xfsICoreSize
+	longName := make([]byte, literalArea) // guaranteed to overflow on its own
+	for i := range longName {
+		longName[i] = 'a'
+	}
+	if err := x.CalcRegFileSize(string(longName), 0); err != nil {
+		t.Fatalf("CalcRegFileSize: %v", err)
+	}
+	if x.totalSize != before+4096+0 { // +BlockSize for the block-form dir; file itself is 0 bytes, no extra block
+		t.Fatalf("first overflowing entry added %d bytes, want a single block-form directory block", x.totalSize-before)
+	}
+
+	before = x.totalSize
+	if err := x.CalcRegFileSize("b", 0); err != nil {
+		t.Fatalf("CalcRegFileSize: %v", err)
+	}
+	if x.totalSize != before {
+		t.Fatalf("entry after overflow added %d more bytes, want 0 (already paying for the block-form block)", x.totalSize-before)
+	}
+}
+
+// TestXfsFsInodeChunking checks that FinalizeSizeContext rounds the inode
+// count up to a whole 64-inode chunk even when only one inode in it is
+// actually used.
+func TestXfsFsInodeChunking(t *testing.T) {
+	x := &XfsFs{BlockSize: 4096, InodeSize: 256}
+	if err := x.InitSizeContext(); err != nil {
+		t.Fatalf("InitSizeContext: %v", err)
+	}
+	if err := x.FinalizeSizeContext(); err != nil {
+		t.Fatalf("FinalizeSizeContext: %v", err)
+	}
+	if x.numInodes != xfsInodesPerChunk {
+		t.Fatalf("numInodes = %d, want a full chunk of %d", x.numInodes, xfsInodesPerChunk)
+	}
+}